@@ -5,6 +5,7 @@ package atomicstore
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/edge/atomiccounter"
 )
@@ -32,9 +33,20 @@ type Store struct {
 	onBatchInsert func(KV)
 	onBatchUpdate func(KV)
 	onBatchRemove func(KV)
+	persist       *persistence
+	pub           *publisher
+	mvcc          *mvccIndex
+	txMu          sync.Mutex
+	ttlWheel      *timerWheel
+	onExpire      func(string, interface{})
+	defaultTTL    time.Duration
 	sync.Map
 }
 
+// mvccCompactInterval is how often the MVCC garbage collector looks
+// for versions no live Snapshot can still see.
+const mvccCompactInterval = 30 * time.Second
+
 // lockable returns true when a sync.Cond is present.
 func (s *Store) lockable() bool {
 	return s.cond != nil
@@ -56,8 +68,15 @@ func (s *Store) insert(key, val interface{}, o options) (interface{}, bool) {
 		resp, loaded := s.LoadOrStore(key, val)
 		if !loaded {
 			s.count.Inc()
-			if o.runCallbacks && s.onInsert != nil {
-				s.onInsert(key.(string), resp)
+			s.mvcc.record(key.(string), resp, false)
+			if s.persist != nil {
+				s.persist.append(walOpInsert, key.(string), resp)
+			}
+			if o.runCallbacks {
+				if s.onInsert != nil {
+					s.onInsert(key.(string), resp)
+				}
+				s.publish([]Event{{Type: EventInsert, Key: key.(string), Value: resp}})
 			}
 		}
 		return resp, loaded
@@ -66,26 +85,48 @@ func (s *Store) insert(key, val interface{}, o options) (interface{}, bool) {
 	// Check for value
 	_, exists := s.Get(key)
 	s.Store(key, val)
+	s.mvcc.record(key.(string), val, false)
+
+	if s.persist != nil {
+		s.persist.append(walOpInsert, key.(string), val)
+	}
 
 	if !exists {
 		s.count.Inc()
 		if o.runCallbacks {
 			s.onInsert(key.(string), val)
+			s.publish([]Event{{Type: EventInsert, Key: key.(string), Value: val}})
 		}
 	} else if o.runCallbacks {
 		s.onUpdate(key.(string), val)
+		s.publish([]Event{{Type: EventUpdate, Key: key.(string), Value: val}})
 	}
 
 	return val, exists
 }
 
-// Insert creates a new entry or overwrites the existing.
+// Insert creates a new entry or overwrites the existing. If
+// SetDefaultTTL has been called, the entry is scheduled to expire
+// accordingly; use InsertWithTTL for a per-entry TTL instead.
+//
+// Insert takes txMu, the same lock Batch.Commit holds for its
+// read-set check and apply loop, so a direct write can't land in the
+// window between a Commit verifying no conflict and applying its jobs.
 func (s *Store) Insert(key string, val interface{}) (interface{}, bool) {
-	return s.insert(key, val, options{unique: false, runCallbacks: true})
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	resp, exists := s.insert(key, val, options{unique: false, runCallbacks: true})
+	if s.defaultTTL > 0 {
+		s.ttlWheel.schedule(key, s.defaultTTL)
+	}
+	return resp, exists
 }
 
-// InsertUnique creates a new entry if the key doesn't exist.
+// InsertUnique creates a new entry if the key doesn't exist. See
+// Insert for why it takes txMu.
 func (s *Store) InsertUnique(key string, val interface{}) (interface{}, bool) {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
 	return s.insert(key, val, options{unique: true, runCallbacks: true})
 }
 
@@ -99,17 +140,26 @@ func (s *Store) remove(key interface{}, o options) (interface{}, bool) {
 	if resp, ok := s.Get(key); ok {
 		s.count.Dec()
 		s.Delete(key)
+		s.mvcc.record(key.(string), nil, true)
+		s.ttlWheel.cancel(key.(string))
+		if s.persist != nil {
+			s.persist.append(walOpRemove, key.(string), nil)
+		}
 		// This entry already exists. Overwrite it.
 		if o.runCallbacks {
 			s.onRemove(key.(string), resp)
+			s.publish([]Event{{Type: EventRemove, Key: key.(string), Value: resp}})
 		}
 		return resp, true
 	}
 	return nil, false
 }
 
-// Remove deletes a key from the store.
+// Remove deletes a key from the store. See Insert for why it takes
+// txMu.
 func (s *Store) Remove(key interface{}) bool {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
 	_, success := s.remove(key, options{runCallbacks: true})
 	return success
 }
@@ -203,7 +253,10 @@ func (s *Store) OnBatchRemoveHandler(f func(KV)) {
 	s.onBatchRemove = f
 }
 
-// New returns a new store.
+// New returns a new store. It starts two background goroutines for the
+// life of the store, an MVCC compactor and a TTL expirer, so callers
+// must call Close when done with it to stop them - even a Store that
+// was never opened with NewPersistent and never uses TTLs.
 func New(lockable bool) *Store {
 	s := &Store{
 		count:         atomiccounter.New(),
@@ -213,10 +266,15 @@ func New(lockable bool) *Store {
 		onBatchInsert: defaultBatchCallback,
 		onBatchUpdate: defaultBatchCallback,
 		onBatchRemove: defaultBatchCallback,
+		pub:           newPublisher(),
+		mvcc:          newMVCCIndex(),
+		ttlWheel:      newTimerWheel(),
 	}
 	if lockable {
 		s.cond = sync.NewCond(new(sync.Mutex))
 	}
+	go s.mvcc.compact(mvccCompactInterval)
+	go s.ttlWheel.run(s)
 
 	return s
 }
@@ -0,0 +1,58 @@
+// Edge Network
+// (c) 2021 Edge Network technologies Ltd.
+package atomicstore
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestInsertRemoveGet(t *testing.T) {
+	s := New(false)
+	defer s.Close()
+
+	s.Insert("a", 1)
+	s.Insert("b", 2)
+	if v, ok := s.Get("a"); !ok || v != 1 {
+		t.Fatalf("Get(a): want (1, true), got (%v, %v)", v, ok)
+	}
+	if s.Len() != 2 {
+		t.Fatalf("Len: want 2, got %d", s.Len())
+	}
+
+	if !s.Remove("a") {
+		t.Fatalf("Remove(a): want true")
+	}
+	if _, ok := s.Get("a"); ok {
+		t.Fatalf("Get(a) after Remove: want not found")
+	}
+	if s.Len() != 1 {
+		t.Fatalf("Len after Remove: want 1, got %d", s.Len())
+	}
+}
+
+// TestCloseStopsBackgroundGoroutines checks that Close stops the MVCC
+// compactor and TTL expirer goroutines New starts, even for a Store
+// that never touches TTLs or persistence.
+func TestCloseStopsBackgroundGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	const stores = 50
+	for i := 0; i < stores; i++ {
+		s := New(false)
+		s.Insert("k", "v")
+		if err := s.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if runtime.NumGoroutine() <= before+5 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("goroutine count did not settle after closing %d stores: before=%d after=%d", stores, before, runtime.NumGoroutine())
+}
@@ -3,9 +3,18 @@
 package atomicstore
 
 import (
+	"errors"
 	"sync"
 )
 
+// ErrConflict is returned by Commit when a key the batch read was
+// written by another transaction after the batch started.
+var ErrConflict = errors.New("atomicstore: commit conflict: a read key was modified concurrently")
+
+// ErrBatchClosed is returned by Commit or Rollback on a batch that has
+// already been committed or rolled back.
+var ErrBatchClosed = errors.New("atomicstore: batch already committed or rolled back")
+
 const (
 	oppInsert       opp = "insert"
 	oppInsertUnique opp = "insertUnique"
@@ -19,70 +28,213 @@ type job struct {
 	value  interface{}
 }
 
-type batch struct {
+// Batch is a serializable-by-default transaction: Insert/InsertUnique/
+// Remove only stage jobs, Get reads through those pending writes, and
+// nothing touches the store until Commit. Commit verifies that no key
+// the batch read has been written since the batch started and, if not,
+// applies every staged write atomically under the store's transaction
+// lock.
+type Batch struct {
 	sync.RWMutex
-	jobs    []*job
-	created *KV
-	updated *KV
-	deleted *KV
-	store   *Store
+	jobs     []*job
+	writes   map[interface{}]*job
+	readSet  map[interface{}]struct{}
+	startSeq uint64
+	store    *Store
+	done     bool
+}
+
+// Insert stages an insert job.
+func (b *Batch) Insert(key, val interface{}) {
+	b.Lock()
+	defer b.Unlock()
+	b.stage(&job{method: oppInsert, key: key, value: val})
 }
 
-// Insert adds an insert job to the batch.
-func (b *batch) Insert(key, val interface{}) {
+// InsertUnique stages a unique-insert job.
+func (b *Batch) InsertUnique(key, val interface{}) {
 	b.Lock()
 	defer b.Unlock()
-	b.jobs = append(b.jobs, &job{
-		method: oppInsert,
-		key:    key,
-		value:  val,
-	})
+	b.stage(&job{method: oppInsertUnique, key: key, value: val})
+}
+
+// Remove stages a remove job.
+func (b *Batch) Remove(key interface{}) {
+	b.Lock()
+	defer b.Unlock()
+	b.stage(&job{method: oppRemove, key: key})
+}
+
+// stage must be called with b locked.
+func (b *Batch) stage(j *job) {
+	b.jobs = append(b.jobs, j)
+	b.writes[j.key] = j
 }
 
-// InsertUnique adds a unique insert job to the batch.
-func (b *batch) InsertUnique(key, val interface{}) {
+// Get reads key through the batch's pending writes, falling back to
+// the store's current value if the batch hasn't touched key. Reads
+// that fall through to the store are added to the batch's read-set and
+// checked for conflicts on Commit.
+func (b *Batch) Get(key interface{}) (interface{}, bool) {
 	b.Lock()
 	defer b.Unlock()
-	b.jobs = append(b.jobs, &job{
-		method: oppInsertUnique,
-		key:    key,
-		value:  val,
-	})
+	if j, ok := b.writes[key]; ok {
+		if j.method == oppRemove {
+			return nil, false
+		}
+		return j.value, true
+	}
+	b.readSet[key] = struct{}{}
+	return b.store.Get(key)
+}
+
+// Commit verifies that no key in the batch's read-set has been written
+// since the batch started, then applies every staged write atomically
+// and fires the store's batch callbacks and subscriptions. It returns
+// ErrConflict without applying anything if verification fails, and
+// ErrBatchClosed if the batch was already committed or rolled back.
+func (b *Batch) Commit() error {
+	b.Lock()
+	if b.done {
+		b.Unlock()
+		return ErrBatchClosed
+	}
+	jobs := b.jobs
+	readSet := b.readSet
+	b.Unlock()
+
+	b.store.txMu.Lock()
+	defer b.store.txMu.Unlock()
+
+	for key := range readSet {
+		k, ok := key.(string)
+		if !ok {
+			continue
+		}
+		if b.store.mvcc.latestSeq(k) > b.startSeq {
+			return ErrConflict
+		}
+	}
+
+	created := &KV{}
+	updated := &KV{}
+	deleted := &KV{}
+	for _, j := range jobs {
+		switch j.method {
+		case oppInsert, oppInsertUnique:
+			unique := j.method == oppInsertUnique
+			doc, exists := b.store.insert(j.key, j.value, options{unique: unique, runCallbacks: false})
+			if !exists {
+				(*created)[j.key] = doc
+			} else if !unique {
+				(*updated)[j.key] = doc
+			}
+		case oppRemove:
+			if doc, success := b.store.remove(j.key, options{runCallbacks: false}); success {
+				(*deleted)[j.key] = doc
+			}
+		}
+	}
+
+	b.Lock()
+	b.done = true
+	b.Unlock()
+
+	if len(*created) > 0 {
+		if b.store.onBatchInsert != nil {
+			b.store.onBatchInsert(*created)
+		}
+		b.store.publish(eventsFromKV(EventBatchInsert, created))
+	}
+	if len(*updated) > 0 {
+		if b.store.onBatchUpdate != nil {
+			b.store.onBatchUpdate(*updated)
+		}
+		b.store.publish(eventsFromKV(EventBatchUpdate, updated))
+	}
+	if len(*deleted) > 0 {
+		if b.store.onBatchRemove != nil {
+			b.store.onBatchRemove(*deleted)
+		}
+		b.store.publish(eventsFromKV(EventBatchRemove, deleted))
+	}
+
+	return nil
 }
 
-// Remove adds a remove job to the batch.
-func (b *batch) Remove(key interface{}) {
+// Rollback discards every staged job. Since Commit is the only thing
+// that ever touches the store, this is just bookkeeping: nothing needs
+// to be undone there.
+func (b *Batch) Rollback() error {
 	b.Lock()
 	defer b.Unlock()
-	b.jobs = append(b.jobs, &job{
-		method: oppRemove,
-		key:    key,
-	})
+	if b.done {
+		return ErrBatchClosed
+	}
+	b.jobs = nil
+	b.writes = nil
+	b.readSet = nil
+	b.done = true
+	return nil
+}
+
+// eventsFromKV converts a batch result map into a slice of Events of
+// the given type, for delivery to Subscribe callbacks.
+func eventsFromKV(t EventType, kv *KV) []Event {
+	events := make([]Event, 0, len(*kv))
+	for k, v := range *kv {
+		events = append(events, Event{Type: t, Key: k.(string), Value: v})
+	}
+	return events
 }
 
-// Execute runs each batched job.
-func (b *batch) Execute() {
+// ExecuteConcurrent runs every staged job in its own goroutine and
+// fires the batch callbacks and subscriptions, matching the original
+// Execute behaviour:
+// it is faster than Commit but lossy under contention, since concurrent
+// jobs race on overlapping keys with no conflict detection and no
+// ordering guarantee. Prefer Commit unless that race is acceptable.
+func (b *Batch) ExecuteConcurrent() {
+	b.Lock()
+	jobs := b.jobs
+	b.Unlock()
+
+	created := &KV{}
+	updated := &KV{}
+	deleted := &KV{}
+	var resultMu sync.Mutex
+
 	var wg sync.WaitGroup
-	for _, v := range b.jobs {
+	for _, j := range jobs {
 		wg.Add(1)
-		go b.do(v, &wg)
+		go b.doConcurrent(j, created, updated, deleted, &resultMu, &wg)
 	}
 	wg.Wait()
 
-	if b.created.Len() > 0 && b.store.onBatchInsert != nil {
-		b.store.onBatchInsert(b.created)
+	if len(*created) > 0 {
+		if b.store.onBatchInsert != nil {
+			b.store.onBatchInsert(*created)
+		}
+		b.store.publish(eventsFromKV(EventBatchInsert, created))
 	}
-
-	if b.updated.Len() > 0 && b.store.onBatchUpdate != nil {
-		b.store.onBatchUpdate(b.updated)
+	if len(*updated) > 0 {
+		if b.store.onBatchUpdate != nil {
+			b.store.onBatchUpdate(*updated)
+		}
+		b.store.publish(eventsFromKV(EventBatchUpdate, updated))
 	}
-
-	if b.deleted.Len() > 0 && b.store.onBatchRemove != nil {
-		b.store.onBatchRemove(b.deleted)
+	if len(*deleted) > 0 {
+		if b.store.onBatchRemove != nil {
+			b.store.onBatchRemove(*deleted)
+		}
+		b.store.publish(eventsFromKV(EventBatchRemove, deleted))
 	}
 }
 
-func (b *batch) do(j *job, wg *sync.WaitGroup) {
+// doConcurrent applies one job to the store; resultMu guards the three
+// shared result maps, since created/updated/deleted are plain maps and
+// not safe for concurrent writes on their own.
+func (b *Batch) doConcurrent(j *job, created, updated, deleted *KV, resultMu *sync.Mutex, wg *sync.WaitGroup) {
 	defer wg.Done()
 	switch j.method {
 	case oppInsert, oppInsertUnique:
@@ -94,25 +246,31 @@ func (b *batch) do(j *job, wg *sync.WaitGroup) {
 		})
 
 		// If the document is update and this isn't a unique key
+		resultMu.Lock()
 		if !exists {
-			(*b.created)[j.key] = doc
+			(*created)[j.key] = doc
 		} else if !unique {
-			(*b.updated)[j.key] = doc
+			(*updated)[j.key] = doc
 		}
+		resultMu.Unlock()
 	case oppRemove:
 		if doc, success := b.store.remove(j.key, options{runCallbacks: false}); success {
-			(*b.deleted)[j.key] = doc
+			resultMu.Lock()
+			(*deleted)[j.key] = doc
+			resultMu.Unlock()
 		}
 	}
 }
 
-// Batch returns a new batch operation struct.
-func (s *Store) Batch() *batch {
-	return &batch{
-		store:   s,
-		jobs:    make([]*job, 0),
-		created: &KV{},
-		updated: &KV{},
-		deleted: &KV{},
+// Batch returns a new transaction. Reads it hasn't written itself fall
+// through to the store and are tracked for conflict detection; nothing
+// is applied to the store until Commit.
+func (s *Store) Batch() *Batch {
+	return &Batch{
+		store:    s,
+		jobs:     make([]*job, 0),
+		writes:   make(map[interface{}]*job),
+		readSet:  make(map[interface{}]struct{}),
+		startSeq: s.mvcc.seq.Get(),
 	}
 }
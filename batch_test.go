@@ -0,0 +1,80 @@
+// Edge Network
+// (c) 2021 Edge Network technologies Ltd.
+package atomicstore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestBatchCommitDetectsConflict(t *testing.T) {
+	s := New(false)
+	defer s.Close()
+
+	s.Insert("bal", 100)
+
+	stale := s.Batch()
+	if v, ok := stale.Get("bal"); !ok || v != 100 {
+		t.Fatalf("Get: want (100, true), got (%v, %v)", v, ok)
+	}
+	stale.Insert("bal", 50)
+
+	fresh := s.Batch()
+	fresh.Get("bal")
+	fresh.Insert("bal", 999)
+	if err := fresh.Commit(); err != nil {
+		t.Fatalf("Commit: unexpected error %v", err)
+	}
+
+	if err := stale.Commit(); err != ErrConflict {
+		t.Fatalf("Commit: want ErrConflict, got %v", err)
+	}
+
+	if v, _ := s.Get("bal"); v != 999 {
+		t.Fatalf("store should still hold the winning commit's value, got %v", v)
+	}
+}
+
+func TestBatchCommitThenCommitIsClosed(t *testing.T) {
+	s := New(false)
+	defer s.Close()
+
+	b := s.Batch()
+	b.Insert("k", "v")
+	if err := b.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := b.Commit(); err != ErrBatchClosed {
+		t.Fatalf("second Commit: want ErrBatchClosed, got %v", err)
+	}
+	if err := b.Rollback(); err != ErrBatchClosed {
+		t.Fatalf("Rollback after Commit: want ErrBatchClosed, got %v", err)
+	}
+}
+
+// TestExecuteConcurrentNoDataRace guards against created/updated/deleted
+// being plain maps written from multiple job goroutines with no lock;
+// run with -race.
+func TestExecuteConcurrentNoDataRace(t *testing.T) {
+	s := New(false)
+	defer s.Close()
+
+	b := s.Batch()
+	const n = 200
+	for i := 0; i < n; i++ {
+		b.Insert(fmt.Sprintf("k%d", i), i)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.ExecuteConcurrent()
+	}()
+	wg.Wait()
+
+	if got := s.Len(); got != n {
+		t.Fatalf("Len: want %d, got %d", n, got)
+	}
+}
@@ -0,0 +1,237 @@
+// Edge Network
+// (c) 2021 Edge Network technologies Ltd.
+package atomicstore
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/edge/atomiccounter"
+)
+
+// version is a single (key, seq) entry. Entries are never mutated in
+// place; an insert or remove appends a new version rather than
+// overwriting the last one, so a Snapshot taken before the write keeps
+// seeing the value it started with.
+type version struct {
+	seq       uint64
+	val       interface{}
+	tombstone bool
+}
+
+// seqHeap is a min-heap of live snapshot sequence numbers. The
+// compactor only needs the minimum to know which versions are still
+// reachable, so closed snapshots are lazily dropped from the top
+// rather than removed from the middle of the heap.
+type seqHeap []uint64
+
+func (h seqHeap) Len() int            { return len(h) }
+func (h seqHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h seqHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *seqHeap) Push(x interface{}) { *h = append(*h, x.(uint64)) }
+func (h *seqHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	v := old[n-1]
+	*h = old[:n-1]
+	return v
+}
+
+// mvccIndex tracks every version of every key and the set of snapshot
+// sequence numbers still in use, so the compactor knows what it's safe
+// to drop.
+type mvccIndex struct {
+	seq      *atomiccounter.Counter
+	mu       sync.Mutex
+	versions map[string][]version
+	live     seqHeap
+	liveRefs map[uint64]int
+	stop     chan struct{}
+}
+
+func newMVCCIndex() *mvccIndex {
+	return &mvccIndex{
+		seq:      atomiccounter.New(),
+		versions: make(map[string][]version),
+		liveRefs: make(map[uint64]int),
+		stop:     make(chan struct{}),
+	}
+}
+
+// record appends a new version for key, returning its sequence number.
+// seq is assigned while holding m.mu so that two concurrent writers to
+// the same key can't acquire the mutex in the opposite order from the
+// sequence numbers they were handed, which would append versions[key]
+// out of seq order (the same pattern persistence.append uses for the
+// WAL counter).
+func (m *mvccIndex) record(key string, val interface{}, tombstone bool) uint64 {
+	m.mu.Lock()
+	seq := m.seq.Inc()
+	m.versions[key] = append(m.versions[key], version{seq: seq, val: val, tombstone: tombstone})
+	m.mu.Unlock()
+	return seq
+}
+
+// at returns the highest version of key visible at seq.
+func (m *mvccIndex) at(key string, seq uint64) (interface{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	vs := m.versions[key]
+	for i := len(vs) - 1; i >= 0; i-- {
+		if vs[i].seq <= seq {
+			if vs[i].tombstone {
+				return nil, false
+			}
+			return vs[i].val, true
+		}
+	}
+	return nil, false
+}
+
+// rangeAt calls fn for the highest version ≤ seq of every key that has one.
+func (m *mvccIndex) rangeAt(seq uint64, fn func(key string, val interface{}) bool) {
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.versions))
+	for k := range m.versions {
+		keys = append(keys, k)
+	}
+	m.mu.Unlock()
+
+	for _, k := range keys {
+		if val, ok := m.at(k, seq); ok {
+			if !fn(k, val) {
+				return
+			}
+		}
+	}
+}
+
+// latestSeq returns the sequence number of the newest version of key,
+// or 0 if key has never been written.
+func (m *mvccIndex) latestSeq(key string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	vs := m.versions[key]
+	if len(vs) == 0 {
+		return 0
+	}
+	return vs[len(vs)-1].seq
+}
+
+// trackLive reads the current seq and registers it as in-use under the
+// same lock, so gc can't prune a version the new snapshot needs between
+// the two steps. It returns the registered seq.
+func (m *mvccIndex) trackLive() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seq := m.seq.Get()
+	if m.liveRefs[seq] == 0 {
+		heap.Push(&m.live, seq)
+	}
+	m.liveRefs[seq]++
+	return seq
+}
+
+// untrackLive releases a snapshot's hold on seq.
+func (m *mvccIndex) untrackLive(seq uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.liveRefs[seq] > 0 {
+		m.liveRefs[seq]--
+	}
+}
+
+// minLive returns the lowest in-use snapshot seq, popping any entries
+// whose ref count has dropped to zero, or the current seq if nothing
+// holds a snapshot open.
+func (m *mvccIndex) minLive() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.live.Len() > 0 && m.liveRefs[m.live[0]] == 0 {
+		heap.Pop(&m.live)
+	}
+	if m.live.Len() > 0 {
+		return m.live[0]
+	}
+	return m.seq.Get()
+}
+
+// gc drops versions older than the oldest version any live snapshot
+// could still need: for each key it keeps the newest version ≤ minSeq
+// (snapshots taken at or after that version still need it) plus
+// everything newer.
+func (m *mvccIndex) gc() {
+	minSeq := m.minLive()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, vs := range m.versions {
+		keepFrom := 0
+		for i, v := range vs {
+			if v.seq <= minSeq {
+				keepFrom = i
+			} else {
+				break
+			}
+		}
+		if keepFrom > 0 {
+			m.versions[key] = append([]version(nil), vs[keepFrom:]...)
+		}
+	}
+}
+
+func (m *mvccIndex) compact(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.gc()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Snapshot is a consistent, point-in-time view of a Store: Get and
+// Range on it only ever see the data as it stood when the snapshot was
+// taken, no matter how the store mutates afterwards. Call Close when
+// done so the compactor can reclaim versions it was pinning.
+type Snapshot struct {
+	store *Store
+	seq   uint64
+}
+
+// Get returns the value of key as of the snapshot's seq.
+func (snap *Snapshot) Get(key string) (interface{}, bool) {
+	return snap.store.mvcc.at(key, snap.seq)
+}
+
+// Range calls fn for every key visible at the snapshot's seq, in no
+// particular order, until fn returns false.
+func (snap *Snapshot) Range(fn func(key string, val interface{}) bool) {
+	snap.store.mvcc.rangeAt(snap.seq, fn)
+}
+
+// Close releases the snapshot's hold on its versions. A Snapshot that
+// is never closed pins those versions from the compactor forever.
+func (snap *Snapshot) Close() {
+	snap.store.mvcc.untrackLive(snap.seq)
+}
+
+// Snapshot captures the store's current sequence number and returns a
+// Snapshot that reads a stable view as of that point, regardless of
+// writes made after it's taken.
+func (s *Store) Snapshot() *Snapshot {
+	seq := s.mvcc.trackLive()
+	return &Snapshot{store: s, seq: seq}
+}
+
+// View runs fn against a Snapshot and always closes it afterwards,
+// whether or not fn returns an error.
+func (s *Store) View(fn func(*Snapshot) error) error {
+	snap := s.Snapshot()
+	defer snap.Close()
+	return fn(snap)
+}
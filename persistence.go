@@ -0,0 +1,285 @@
+// Edge Network
+// (c) 2021 Edge Network technologies Ltd.
+package atomicstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Codec marshals and unmarshals stored values to and from their
+// persisted byte representation.
+type Codec interface {
+	Marshal(val interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+// Persistence is a pluggable key/value backend (e.g. BoltDB, BadgerDB,
+// LevelDB) used to durably store the WAL and periodic snapshots.
+// Implementations need only offer a flat byte-oriented keyspace; the
+// store namespaces keys internally.
+type Persistence interface {
+	// Put stores a raw key/value pair, overwriting any existing value.
+	Put(key, value []byte) error
+	// Get retrieves a raw value. ok is false if the key is absent.
+	Get(key []byte) (value []byte, ok bool, err error)
+	// Delete removes a raw key. It is not an error if the key is absent.
+	Delete(key []byte) error
+	// Scan calls fn for every key with the given prefix, in key order.
+	Scan(prefix []byte, fn func(key, value []byte) error) error
+	// Close releases the backend.
+	Close() error
+}
+
+// PersistConfig configures a durable, WAL-backed Store.
+type PersistConfig struct {
+	// Backend is the KV engine adapter the WAL and snapshots are written to.
+	Backend Persistence
+	// Codec marshals stored values for persistence.
+	Codec Codec
+	// SnapshotInterval is how often the background compactor checkpoints.
+	// A zero value disables automatic snapshotting; Checkpoint can still
+	// be called manually.
+	SnapshotInterval time.Duration
+}
+
+const (
+	walPrefix      = "wal/"
+	snapPrefix     = "snap/"
+	snapSeqKey     = "meta/snapSeq"
+	walOpInsert    = byte('i')
+	walOpRemove    = byte('r')
+)
+
+// walEntry is a single write-ahead log record.
+type walEntry struct {
+	Seq   uint64
+	Op    byte
+	Key   string
+	Value []byte
+}
+
+// persistence wires a Store to a Persistence backend: it appends a WAL
+// entry for every mutation and periodically flushes a consistent
+// snapshot, truncating the WAL behind it. seqMu guards seq: Insert,
+// Remove and Batch.Commit are serialized by the store's txMu, but
+// Batch.ExecuteConcurrent calls into append from several goroutines at
+// once and Checkpoint reads seq from the compactor goroutine.
+type persistence struct {
+	backend  Persistence
+	codec    Codec
+	interval time.Duration
+	seqMu    sync.Mutex
+	seq      uint64
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func walKey(seq uint64) []byte {
+	b := make([]byte, len(walPrefix)+8)
+	copy(b, walPrefix)
+	binary.BigEndian.PutUint64(b[len(walPrefix):], seq)
+	return b
+}
+
+func snapKey(key string) []byte {
+	return append([]byte(snapPrefix), key...)
+}
+
+// NewPersistent returns a Store durably backed by cfg.Backend. On
+// construction it replays the latest snapshot plus any trailing WAL
+// entries to reconstruct state, then starts a background compactor
+// that periodically checkpoints and truncates the WAL.
+func NewPersistent(cfg PersistConfig) (*Store, error) {
+	if cfg.Backend == nil {
+		return nil, fmt.Errorf("atomicstore: PersistConfig.Backend is required")
+	}
+	if cfg.Codec == nil {
+		return nil, fmt.Errorf("atomicstore: PersistConfig.Codec is required")
+	}
+
+	s := New(false)
+	p := &persistence{
+		backend:  cfg.Backend,
+		codec:    cfg.Codec,
+		interval: cfg.SnapshotInterval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if err := p.replay(s); err != nil {
+		return nil, fmt.Errorf("atomicstore: replay failed: %w", err)
+	}
+	s.persist = p
+
+	if p.interval > 0 {
+		go p.compact(s)
+	} else {
+		close(p.done)
+	}
+
+	return s, nil
+}
+
+// replay restores a Store's state from the latest snapshot plus any
+// WAL entries written after it.
+func (p *persistence) replay(s *Store) error {
+	var snapSeq uint64
+	if raw, ok, err := p.backend.Get([]byte(snapSeqKey)); err != nil {
+		return err
+	} else if ok {
+		snapSeq = binary.BigEndian.Uint64(raw)
+	}
+	// New WAL entries must number above snapSeq, or the next replay
+	// would skip them as already covered by the snapshot.
+	p.seq = snapSeq
+
+	if err := p.backend.Scan([]byte(snapPrefix), func(key, value []byte) error {
+		val, err := p.codec.Unmarshal(value)
+		if err != nil {
+			return err
+		}
+		k := string(key[len(snapPrefix):])
+		s.insert(k, val, options{unique: false, runCallbacks: false})
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return p.backend.Scan([]byte(walPrefix), func(key, value []byte) error {
+		seq := binary.BigEndian.Uint64(key[len(walPrefix):])
+		if seq <= snapSeq {
+			return nil
+		}
+		var e walEntry
+		if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&e); err != nil {
+			return err
+		}
+		switch e.Op {
+		case walOpInsert:
+			val, err := p.codec.Unmarshal(e.Value)
+			if err != nil {
+				return err
+			}
+			s.insert(e.Key, val, options{unique: false, runCallbacks: false})
+		case walOpRemove:
+			s.remove(e.Key, options{runCallbacks: false})
+		}
+		if seq > p.seq {
+			p.seq = seq
+		}
+		return nil
+	})
+}
+
+// append writes a single WAL entry for a mutation.
+func (p *persistence) append(op byte, key string, val interface{}) error {
+	var encoded []byte
+	if op == walOpInsert {
+		v, err := p.codec.Marshal(val)
+		if err != nil {
+			return err
+		}
+		encoded = v
+	}
+
+	p.seqMu.Lock()
+	p.seq++
+	seq := p.seq
+	p.seqMu.Unlock()
+
+	e := walEntry{Seq: seq, Op: op, Key: key, Value: encoded}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		return err
+	}
+	return p.backend.Put(walKey(seq), buf.Bytes())
+}
+
+// compact runs on a ticker, checkpointing the store until Close stops it.
+func (p *persistence) compact(s *Store) {
+	defer close(p.done)
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			_ = s.Checkpoint()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Checkpoint forces a consistent snapshot of the store to the
+// persistence backend and truncates the WAL behind it.
+func (s *Store) Checkpoint() error {
+	if s.persist == nil {
+		return fmt.Errorf("atomicstore: store is not persistent")
+	}
+	p := s.persist
+
+	p.seqMu.Lock()
+	seq := p.seq
+	p.seqMu.Unlock()
+
+	// Drop snapshot entries of keys no longer in the store, so a removed
+	// key isn't restored by the next replay.
+	if err := p.backend.Scan([]byte(snapPrefix), func(key, _ []byte) error {
+		if _, ok := s.Load(string(key[len(snapPrefix):])); ok {
+			return nil
+		}
+		return p.backend.Delete(key)
+	}); err != nil {
+		return err
+	}
+
+	var rangeErr error
+	s.Range(func(k, v interface{}) bool {
+		data, err := p.codec.Marshal(v)
+		if err != nil {
+			rangeErr = err
+			return false
+		}
+		rangeErr = p.backend.Put(snapKey(k.(string)), data)
+		return rangeErr == nil
+	})
+	if rangeErr != nil {
+		return rangeErr
+	}
+
+	seqBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqBytes, seq)
+	if err := p.backend.Put([]byte(snapSeqKey), seqBytes); err != nil {
+		return err
+	}
+
+	return p.backend.Scan([]byte(walPrefix), func(key, _ []byte) error {
+		if binary.BigEndian.Uint64(key[len(walPrefix):]) > seq {
+			return nil
+		}
+		return p.backend.Delete(key)
+	})
+}
+
+// Close stops the store's background compactors and, if it was opened
+// with NewPersistent, flushes a final checkpoint and releases the
+// persistence backend.
+func (s *Store) Close() error {
+	close(s.mvcc.stop)
+	close(s.ttlWheel.stop)
+
+	if s.persist == nil {
+		return nil
+	}
+	close(s.persist.stop)
+	<-s.persist.done
+	if err := s.Checkpoint(); err != nil {
+		return err
+	}
+	return s.persist.backend.Close()
+}
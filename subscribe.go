@@ -0,0 +1,240 @@
+// Edge Network
+// (c) 2021 Edge Network technologies Ltd.
+package atomicstore
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType identifies the kind of mutation a subscriber is notified of.
+type EventType string
+
+const (
+	EventInsert      EventType = "insert"
+	EventUpdate      EventType = "update"
+	EventRemove      EventType = "remove"
+	EventBatchInsert EventType = "batchInsert"
+	EventBatchUpdate EventType = "batchUpdate"
+	EventBatchRemove EventType = "batchRemove"
+)
+
+// Event describes a single key mutation delivered to a subscriber.
+type Event struct {
+	Type  EventType
+	Key   string
+	Value interface{}
+}
+
+// SubscriptionID identifies a live Subscribe call so it can be cancelled
+// with Unsubscribe.
+type SubscriptionID uint64
+
+// DeliveryMode controls what Publish does when a subscriber's buffer is full.
+type DeliveryMode int
+
+const (
+	// DeliveryDropWithMetric drops the batch and increments Dropped
+	// rather than block the writer.
+	DeliveryDropWithMetric DeliveryMode = iota
+	// DeliveryBlockWithTimeout blocks the writer for up to the timeout
+	// given to SetDeliveryMode before dropping the batch.
+	DeliveryBlockWithTimeout
+)
+
+const defaultSendBuffer = 64
+
+// subscriber holds one Subscribe call's delivery state. active is read
+// and written atomically so Publish can skip a cancelled subscriber
+// without taking the publisher lock. done signals deliver to exit; it
+// is closed exactly once (guarded by closeOnce), never sendCh, so a
+// concurrent publish can never send on a closed channel.
+type subscriber struct {
+	id        SubscriptionID
+	prefixes  []string
+	cb        func(Event) error
+	sendCh    chan []Event
+	active    int32
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (sub *subscriber) matches(key string) bool {
+	if len(sub.prefixes) == 0 {
+		return true
+	}
+	for _, p := range sub.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// publisher fans out store mutations to subscribers. mode and timeout
+// are written by SetDeliveryMode under mu and read by publish under it.
+type publisher struct {
+	mu      sync.RWMutex
+	subs    map[SubscriptionID]*subscriber
+	nextID  uint64
+	mode    DeliveryMode
+	timeout time.Duration
+	dropped uint64
+}
+
+func newPublisher() *publisher {
+	return &publisher{subs: make(map[SubscriptionID]*subscriber)}
+}
+
+// Dropped returns the number of batches dropped under DeliveryDropWithMetric
+// (or after a DeliveryBlockWithTimeout timeout) since the store was created.
+func (p *publisher) Dropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+// Subscribe registers cb to be called for every Insert/Update/Remove and
+// Batch* event on a key matching any of prefixes (all keys, if prefixes
+// is empty). cb runs on a dedicated goroutine per subscription, so a
+// slow callback only ever backs up its own buffer. Cancelling ctx stops
+// delivery and frees the subscription; callers may also call Unsubscribe.
+func (s *Store) Subscribe(ctx context.Context, prefixes []string, cb func(Event) error) (SubscriptionID, error) {
+	p := s.pub
+	p.mu.Lock()
+	p.nextID++
+	id := SubscriptionID(p.nextID)
+	sub := &subscriber{
+		id:       id,
+		prefixes: prefixes,
+		cb:       cb,
+		sendCh:   make(chan []Event, defaultSendBuffer),
+		active:   1,
+		done:     make(chan struct{}),
+	}
+	p.subs[id] = sub
+	p.mu.Unlock()
+
+	go sub.deliver()
+	go func() {
+		<-ctx.Done()
+		p.remove(sub)
+	}()
+
+	return id, nil
+}
+
+// Unsubscribe cancels a subscription registered with Subscribe.
+func (s *Store) Unsubscribe(id SubscriptionID) {
+	p := s.pub
+	p.mu.RLock()
+	sub, ok := p.subs[id]
+	p.mu.RUnlock()
+	if ok {
+		p.remove(sub)
+	}
+}
+
+// remove deactivates a subscriber, signals deliver to stop, drains any
+// buffered batches so a publish blocked on a full channel in
+// DeliveryBlockWithTimeout mode doesn't wait out its full timeout, then
+// deletes it under the publisher lock. Deactivating and draining happen
+// *before* taking the lock so a writer blocked in Publish (holding no
+// lock of its own, just waiting on sendCh) is never stuck behind the
+// same lock this needs to acquire.
+func (p *publisher) remove(sub *subscriber) {
+	atomic.StoreInt32(&sub.active, 0)
+	sub.closeOnce.Do(func() { close(sub.done) })
+	for {
+		select {
+		case <-sub.sendCh:
+		default:
+			p.mu.Lock()
+			delete(p.subs, sub.id)
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+// deliver runs until done is closed, invoking cb for every event in
+// each batch it receives. It selects on done rather than relying on
+// sendCh being closed, since sendCh may still have a publish racing to
+// send on it when the subscription is cancelled.
+func (sub *subscriber) deliver() {
+	for {
+		select {
+		case batch := <-sub.sendCh:
+			for _, e := range batch {
+				_ = sub.cb(e)
+			}
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// publish fans a batch of events (a single mutation, or every key
+// touched by one Batch.Commit) out to matching subscribers in one
+// channel send each, so concurrent writers don't pay per-event
+// channel overhead. Under DeliveryDropWithMetric it never blocks; under
+// DeliveryBlockWithTimeout it waits up to the timeout given to
+// SetDeliveryMode for each subscriber whose buffer is full.
+func (s *Store) publish(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	p := s.pub
+
+	p.mu.RLock()
+	mode, timeout := p.mode, p.timeout
+	subs := make([]*subscriber, 0, len(p.subs))
+	for _, sub := range p.subs {
+		subs = append(subs, sub)
+	}
+	p.mu.RUnlock()
+
+	for _, sub := range subs {
+		if atomic.LoadInt32(&sub.active) == 0 {
+			continue
+		}
+
+		matched := events
+		if len(sub.prefixes) > 0 {
+			matched = nil
+			for _, e := range events {
+				if sub.matches(e.Key) {
+					matched = append(matched, e)
+				}
+			}
+			if len(matched) == 0 {
+				continue
+			}
+		}
+
+		switch mode {
+		case DeliveryBlockWithTimeout:
+			select {
+			case sub.sendCh <- matched:
+			case <-time.After(timeout):
+				atomic.AddUint64(&p.dropped, 1)
+			}
+		default:
+			select {
+			case sub.sendCh <- matched:
+			default:
+				atomic.AddUint64(&p.dropped, 1)
+			}
+		}
+	}
+}
+
+// SetDeliveryMode configures how Publish behaves when a subscriber's
+// buffer is full. timeout is only used by DeliveryBlockWithTimeout.
+func (s *Store) SetDeliveryMode(mode DeliveryMode, timeout time.Duration) {
+	s.pub.mu.Lock()
+	defer s.pub.mu.Unlock()
+	s.pub.mode = mode
+	s.pub.timeout = timeout
+}
@@ -0,0 +1,80 @@
+// Edge Network
+// (c) 2021 Edge Network technologies Ltd.
+package atomicstore
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubscribeDeliversMatchingPrefix(t *testing.T) {
+	s := New(false)
+	defer s.Close()
+
+	var mu sync.Mutex
+	var got []Event
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := s.Subscribe(ctx, []string{"user/"}, func(e Event) error {
+		mu.Lock()
+		got = append(got, e)
+		mu.Unlock()
+		return nil
+	}); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	s.Insert("user/1", "alice")
+	s.Insert("other/1", "ignored")
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(got)
+		mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 || got[0].Key != "user/1" {
+		t.Fatalf("expected exactly one delivered event for user/1, got %+v", got)
+	}
+}
+
+// TestUnsubscribeStopsDeliverGoroutine guards against the deliver
+// goroutine blocking forever on a `range sendCh` after the channel's
+// producer side is torn down but the channel itself is never closed.
+func TestUnsubscribeStopsDeliverGoroutine(t *testing.T) {
+	s := New(false)
+	defer s.Close()
+
+	before := runtime.NumGoroutine()
+
+	const cycles = 100
+	for i := 0; i < cycles; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		id, err := s.Subscribe(ctx, nil, func(Event) error { return nil })
+		if err != nil {
+			t.Fatalf("Subscribe: %v", err)
+		}
+		s.Unsubscribe(id)
+		cancel()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if runtime.NumGoroutine() <= before+5 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("goroutine count did not settle after %d subscribe/unsubscribe cycles: before=%d after=%d", cycles, before, runtime.NumGoroutine())
+}
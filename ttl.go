@@ -0,0 +1,247 @@
+// Edge Network
+// (c) 2021 Edge Network technologies Ltd.
+package atomicstore
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	ttlWheelSize   = 64
+	ttlWheelLevels = 4
+	ttlTick        = time.Second
+)
+
+// ttlEntry is a single key's scheduled expiry. level/bucket record
+// where in the wheel it currently lives so Remove/Touch can find and
+// delete it in O(1) without scanning.
+type ttlEntry struct {
+	key      string
+	deadline uint64 // tick count at which the entry expires
+	level    int
+	bucket   int
+}
+
+// timerWheel is a hashed hierarchical timer wheel: ttlWheelLevels
+// wheels of ttlWheelSize buckets each, where level L's buckets each
+// span ttlWheelSize^L ticks. An entry is filed into the coarsest level
+// whose span still fits its remaining TTL; as the clock advances into
+// that bucket's span, the bucket is cascaded one level down so the
+// entry eventually lands in level 0 and fires on the exact tick.
+// Insert and cancel only ever touch one bucket, so both are O(1); the
+// expirer only wakes once per tick regardless of how many keys it's
+// tracking.
+type timerWheel struct {
+	mu      sync.Mutex
+	tick    uint64 // current tick counter
+	spans   [ttlWheelLevels]uint64
+	buckets [ttlWheelLevels][ttlWheelSize]map[*ttlEntry]struct{}
+	index   map[string]*ttlEntry
+	stop    chan struct{}
+}
+
+func newTimerWheel() *timerWheel {
+	w := &timerWheel{
+		index: make(map[string]*ttlEntry),
+		stop:  make(chan struct{}),
+	}
+	span := uint64(1)
+	for l := 0; l < ttlWheelLevels; l++ {
+		w.spans[l] = span
+		span *= ttlWheelSize
+		for b := 0; b < ttlWheelSize; b++ {
+			w.buckets[l][b] = make(map[*ttlEntry]struct{})
+		}
+	}
+	return w
+}
+
+// levelFor picks the coarsest level whose span still fits offset ticks
+// from now, and the bucket within it that "now + offset" falls into.
+func (w *timerWheel) levelFor(offset uint64) (int, int) {
+	target := w.tick + offset
+	for l := 0; l < ttlWheelLevels-1; l++ {
+		if offset < w.spans[l]*ttlWheelSize {
+			return l, int((target / w.spans[l]) % ttlWheelSize)
+		}
+	}
+	last := ttlWheelLevels - 1
+	return last, int((target / w.spans[last]) % ttlWheelSize)
+}
+
+// schedule files key in for expiry after ttl, replacing any existing
+// schedule for that key.
+func (w *timerWheel) schedule(key string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	offset := uint64(ttl/ttlTick) + 1
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cancelLocked(key)
+
+	level, bucket := w.levelFor(offset)
+	e := &ttlEntry{key: key, deadline: w.tick + offset, level: level, bucket: bucket}
+	w.buckets[level][bucket][e] = struct{}{}
+	w.index[key] = e
+}
+
+// cancel removes key's schedule, if any.
+func (w *timerWheel) cancel(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cancelLocked(key)
+}
+
+func (w *timerWheel) cancelLocked(key string) {
+	e, ok := w.index[key]
+	if !ok {
+		return
+	}
+	delete(w.buckets[e.level][e.bucket], e)
+	delete(w.index, key)
+}
+
+// isScheduled reports whether key currently has a pending expiry in the
+// wheel. Used by Store.expire to tell a key that's genuinely due apart
+// from one that was touched/rewritten after advance() picked it up but
+// before expire ran.
+func (w *timerWheel) isScheduled(key string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.index[key]
+	return ok
+}
+
+// advance moves the wheel forward one tick, cascading any wheel that
+// has just completed a full rotation down into the level below it, and
+// returns the keys whose deadline is this tick.
+func (w *timerWheel) advance() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.tick++
+
+	// Cascade every level that has just wrapped, coarsest first, so
+	// entries migrate down through however many levels they need to
+	// before level 0 is collected below.
+	for l := ttlWheelLevels - 1; l >= 1; l-- {
+		if w.tick%w.spans[l] != 0 {
+			continue
+		}
+		bucket := int((w.tick / w.spans[l]) % ttlWheelSize)
+		entries := w.buckets[l][bucket]
+		w.buckets[l][bucket] = make(map[*ttlEntry]struct{})
+		for e := range entries {
+			delete(w.index, e.key)
+			remaining := uint64(0)
+			if e.deadline > w.tick {
+				remaining = e.deadline - w.tick
+			}
+			newLevel, newBucket := w.levelFor(remaining)
+			e.level, e.bucket = newLevel, newBucket
+			w.buckets[newLevel][newBucket][e] = struct{}{}
+			w.index[e.key] = e
+		}
+	}
+
+	bucket := int(w.tick % ttlWheelSize)
+	due := w.buckets[0][bucket]
+	w.buckets[0][bucket] = make(map[*ttlEntry]struct{})
+
+	keys := make([]string, 0, len(due))
+	for e := range due {
+		delete(w.index, e.key)
+		keys = append(keys, e.key)
+	}
+	return keys
+}
+
+// run ticks the wheel until stopped, expiring keys on s as they come due.
+func (w *timerWheel) run(s *Store) {
+	t := time.NewTicker(ttlTick)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			for _, key := range w.advance() {
+				s.expire(key)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// InsertWithTTL creates or overwrites an entry, scheduling it to expire
+// and fire onExpire after ttl unless TouchTTL, another InsertWithTTL, a
+// Remove, or an Insert while a default TTL is set replaces or cancels
+// that schedule; an Insert with no default TTL leaves it in place.
+// The insert and the schedule both happen under txMu, the same
+// lock expire checks the wheel under, so a concurrent expire of a
+// previous schedule for key can't slip in between them and delete the
+// value this call just wrote.
+func (s *Store) InsertWithTTL(key string, val interface{}, ttl time.Duration) (interface{}, bool) {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	resp, exists := s.insert(key, val, options{unique: false, runCallbacks: true})
+	s.ttlWheel.schedule(key, ttl)
+	return resp, exists
+}
+
+// SetDefaultTTL sets the TTL new entries get when inserted with Insert
+// (as opposed to InsertWithTTL, which always takes its own ttl). A zero
+// duration, the default, disables automatic expiry.
+func (s *Store) SetDefaultTTL(ttl time.Duration) {
+	s.defaultTTL = ttl
+}
+
+// TouchTTL resets key's expiry to ttl from now without rewriting its
+// value. It is a no-op if key doesn't exist. It takes txMu so a
+// concurrent expire can't remove key between the existence check and
+// the reschedule - see expire's isScheduled check.
+func (s *Store) TouchTTL(key string, ttl time.Duration) {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	if _, ok := s.Get(key); !ok {
+		return
+	}
+	s.ttlWheel.schedule(key, ttl)
+}
+
+// OnExpireHandler adds a callback handler fired when a key expires via
+// TTL, as opposed to being removed explicitly.
+func (s *Store) OnExpireHandler(f func(string, interface{})) {
+	s.onExpire = f
+}
+
+// expire removes a key that has lapsed its TTL, running it through the
+// same callback and subscription pipeline as an explicit Remove, plus
+// onExpire. It takes txMu for the same reason Store.Remove does: it's
+// a direct write outside of Batch.Commit's apply loop. It also takes
+// txMu to re-validate against the wheel before removing anything:
+// advance() drops a key from the wheel's index the instant it becomes
+// due, which is a separate step from this call, so a TouchTTL or
+// Insert/InsertWithTTL landing in between can re-arm the key with a
+// fresh schedule. Since those all take txMu too, checking isScheduled
+// here is race-free - if the key's back in the wheel, something
+// rearmed it since it became due, so honor that instead of expiring it.
+func (s *Store) expire(key string) {
+	s.txMu.Lock()
+	if s.ttlWheel.isScheduled(key) {
+		s.txMu.Unlock()
+		return
+	}
+	resp, ok := s.remove(key, options{runCallbacks: false})
+	s.txMu.Unlock()
+	if !ok {
+		return
+	}
+	s.onRemove(key, resp)
+	if s.onExpire != nil {
+		s.onExpire(key, resp)
+	}
+	s.publish([]Event{{Type: EventRemove, Key: key, Value: resp}})
+}
@@ -0,0 +1,167 @@
+// Edge Network
+// (c) 2021 Edge Network technologies Ltd.
+package atomicstore
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTimerWheelScheduleAndCancel(t *testing.T) {
+	w := newTimerWheel()
+
+	w.schedule("a", 5*ttlTick)
+	if _, ok := w.index["a"]; !ok {
+		t.Fatalf("schedule(a): expected an index entry")
+	}
+
+	w.cancel("a")
+	if _, ok := w.index["a"]; ok {
+		t.Fatalf("cancel(a): expected index entry to be removed")
+	}
+}
+
+func TestTimerWheelRescheduleReplacesPrevious(t *testing.T) {
+	w := newTimerWheel()
+
+	w.schedule("a", 5*ttlTick)
+	first := w.index["a"]
+	w.schedule("a", 50*ttlTick)
+	second := w.index["a"]
+
+	if first == second {
+		t.Fatalf("reschedule: expected a new entry, got the same one back")
+	}
+	if len(w.buckets[first.level][first.bucket]) != 0 {
+		t.Fatalf("reschedule: old entry's bucket should have been cleared")
+	}
+}
+
+func TestTimerWheelAdvanceFiresOnDeadline(t *testing.T) {
+	w := newTimerWheel()
+	w.schedule("a", ttlTick)
+
+	if keys := w.advance(); len(keys) != 0 {
+		t.Fatalf("advance 1: want no keys due yet, got %v", keys)
+	}
+	keys := w.advance()
+	if len(keys) != 1 || keys[0] != "a" {
+		t.Fatalf("advance 2: want [a] due, got %v", keys)
+	}
+	if _, ok := w.index["a"]; ok {
+		t.Fatalf("fired entry should be removed from the index")
+	}
+}
+
+func TestTimerWheelCascadesAcrossLevels(t *testing.T) {
+	w := newTimerWheel()
+	ticks := w.spans[1] + 3
+	w.schedule("a", time.Duration(ticks-1)*ttlTick)
+
+	for i := uint64(0); i < ticks-1; i++ {
+		w.advance()
+	}
+	keys := w.advance()
+	if len(keys) != 1 || keys[0] != "a" {
+		t.Fatalf("advance after %d ticks: want [a] due, got %v", ticks, keys)
+	}
+}
+
+// TestInsertWithTTLExpiresThroughStore exercises the full path from
+// InsertWithTTL through the wheel's own ticker to Store.expire, so it
+// runs in real time and is intentionally the only TTL test that does.
+func TestInsertWithTTLExpiresThroughStore(t *testing.T) {
+	s := New(false)
+	defer s.Close()
+
+	expired := make(chan string, 1)
+	s.OnExpireHandler(func(key string, _ interface{}) {
+		expired <- key
+	})
+
+	s.InsertWithTTL("k", "v", 1)
+
+	select {
+	case key := <-expired:
+		if key != "k" {
+			t.Fatalf("onExpire: want key k, got %s", key)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for TTL expiry")
+	}
+	if _, ok := s.Get("k"); ok {
+		t.Fatalf("Get(k) after expiry: want not found")
+	}
+}
+
+// TestExpireHonorsTouchAfterBecomingDue reproduces the window between
+// advance() dropping a key from the wheel's index and run() calling
+// Store.expire on it: a TouchTTL landing in that window must win,
+// not the stale expire. Drives the wheel by hand the way run() does
+// instead of waiting on a real tick.
+func TestExpireHonorsTouchAfterBecomingDue(t *testing.T) {
+	s := New(false)
+	defer s.Close()
+
+	s.InsertWithTTL("k", "v", ttlTick)
+	s.ttlWheel.advance()
+	due := s.ttlWheel.advance()
+	if len(due) != 1 || due[0] != "k" {
+		t.Fatalf("advance: want [k] due, got %v", due)
+	}
+
+	// A TouchTTL lands after advance() made the key due but before
+	// run() gets around to calling expire on it.
+	s.TouchTTL("k", 10*ttlTick)
+
+	for _, key := range due {
+		s.expire(key)
+	}
+
+	if v, ok := s.Get("k"); !ok || v != "v" {
+		t.Fatalf("Get(k) after touch-then-expire: want (v, true), got (%v, %v)", v, ok)
+	}
+	if !s.ttlWheel.isScheduled("k") {
+		t.Fatalf("isScheduled(k): want true, the touch's fresh schedule should survive")
+	}
+}
+
+func TestTouchTTLResetsExpiry(t *testing.T) {
+	s := New(false)
+	defer s.Close()
+
+	s.Insert("k", "v")
+	s.TouchTTL("k", 2*ttlTick)
+	if _, ok := s.ttlWheel.index["k"]; !ok {
+		t.Fatalf("TouchTTL on existing key: expected an index entry")
+	}
+
+	s.TouchTTL("missing", 2*ttlTick)
+	if _, ok := s.ttlWheel.index["missing"]; ok {
+		t.Fatalf("TouchTTL on missing key: want no-op, got an index entry")
+	}
+}
+
+// TestTimerWheelConcurrentScheduleCancelNoDataRace guards against
+// buckets/index being read/written with no lock while schedules,
+// cancels and advances race; run with -race.
+func TestTimerWheelConcurrentScheduleCancelNoDataRace(t *testing.T) {
+	w := newTimerWheel()
+
+	const n = 100
+	var wg sync.WaitGroup
+	wg.Add(n * 2)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			w.schedule("k", 10*ttlTick)
+		}()
+		go func() {
+			defer wg.Done()
+			w.cancel("k")
+		}()
+	}
+	wg.Wait()
+	w.advance()
+}
@@ -0,0 +1,486 @@
+// Edge Network
+// (c) 2021 Edge Network technologies Ltd.
+package atomicstore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/edge/atomiccounter"
+)
+
+// TypedKV stores a map of keyed entries and is used for typed batch
+// actions.
+type TypedKV[K comparable, V any] map[K]V
+
+// TypedStore is a generic counterpart to Store: the same sync.Map-based
+// design, but with a real key type K and value type V instead of
+// interface{}, so callers don't cast on every Get and the store itself
+// doesn't panic when a key isn't a string (the untyped Store's insert,
+// remove and GetKeyMap all assert key.(string) internally). Store is
+// kept as-is, unparametrised, for existing callers; TypedStore is for
+// new code that wants the compile-time safety. It tracks a per-key
+// write sequence (seq/lastSeq), the same mechanism Store's MVCC index
+// uses, purely so TypedBatch.Commit can detect conflicts; it does not
+// carry Store's snapshots, TTL or persistence layers.
+type TypedStore[K comparable, V any] struct {
+	cond          *sync.Cond
+	count         *atomiccounter.Counter
+	onInsert      func(K, V)
+	onUpdate      func(K, V)
+	onRemove      func(K, V)
+	onBatchInsert func(TypedKV[K, V])
+	onBatchUpdate func(TypedKV[K, V])
+	onBatchRemove func(TypedKV[K, V])
+	data          sync.Map
+	seq           *atomiccounter.Counter
+	verMu         sync.Mutex
+	lastSeq       map[K]uint64
+	txMu          sync.Mutex
+}
+
+func (s *TypedStore[K, V]) lockable() bool {
+	return s.cond != nil
+}
+
+// Len returns the size of the store.
+func (s *TypedStore[K, V]) Len() uint64 {
+	return s.count.Get()
+}
+
+// record notes the seq a key was last written at, for TypedBatch.Commit
+// conflict detection. seq is assigned while holding verMu so that two
+// concurrent writers to the same key can't acquire the lock in the
+// opposite order from the sequence numbers they were handed, which
+// would leave lastSeq[key] holding a lower number than was actually
+// last assigned (same fix as mvccIndex.record).
+func (s *TypedStore[K, V]) record(key K) uint64 {
+	s.verMu.Lock()
+	seq := s.seq.Inc()
+	s.lastSeq[key] = seq
+	s.verMu.Unlock()
+	return seq
+}
+
+// latestSeq returns the seq key was last written at, or 0 if never written.
+func (s *TypedStore[K, V]) latestSeq(key K) uint64 {
+	s.verMu.Lock()
+	defer s.verMu.Unlock()
+	return s.lastSeq[key]
+}
+
+func (s *TypedStore[K, V]) insert(key K, val V, o options) (V, bool) {
+	if s.lockable() {
+		s.cond.L.Lock()
+		defer s.cond.L.Unlock()
+	}
+
+	// Unique values only get inserted if they don't already exist.
+	if o.unique {
+		resp, loaded := s.data.LoadOrStore(key, val)
+		if !loaded {
+			s.count.Inc()
+			s.record(key)
+			if o.runCallbacks && s.onInsert != nil {
+				s.onInsert(key, resp.(V))
+			}
+		}
+		return resp.(V), loaded
+	}
+
+	_, exists := s.Get(key)
+	s.data.Store(key, val)
+	s.record(key)
+
+	if !exists {
+		s.count.Inc()
+		if o.runCallbacks {
+			s.onInsert(key, val)
+		}
+	} else if o.runCallbacks {
+		s.onUpdate(key, val)
+	}
+
+	return val, exists
+}
+
+// Insert creates a new entry or overwrites the existing. It takes
+// txMu, the same lock TypedBatch.Commit holds for its read-set check
+// and apply loop, so a direct write can't land in the window between a
+// Commit verifying no conflict and applying its jobs.
+func (s *TypedStore[K, V]) Insert(key K, val V) (V, bool) {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	return s.insert(key, val, options{unique: false, runCallbacks: true})
+}
+
+// InsertUnique creates a new entry if the key doesn't exist. See
+// Insert for why it takes txMu.
+func (s *TypedStore[K, V]) InsertUnique(key K, val V) (V, bool) {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	return s.insert(key, val, options{unique: true, runCallbacks: true})
+}
+
+func (s *TypedStore[K, V]) remove(key K, o options) (V, bool) {
+	if s.lockable() {
+		s.cond.L.Lock()
+		defer s.cond.L.Unlock()
+	}
+
+	if resp, ok := s.Get(key); ok {
+		s.count.Dec()
+		s.data.Delete(key)
+		s.record(key)
+		if o.runCallbacks {
+			s.onRemove(key, resp)
+		}
+		return resp, true
+	}
+	var zero V
+	return zero, false
+}
+
+// Remove deletes a key from the store. See Insert for why it takes
+// txMu.
+func (s *TypedStore[K, V]) Remove(key K) bool {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	_, success := s.remove(key, options{runCallbacks: true})
+	return success
+}
+
+// Get gets the value of a mapped key.
+func (s *TypedStore[K, V]) Get(key K) (V, bool) {
+	val, ok := s.data.Load(key)
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return val.(V), true
+}
+
+// Range calls fn for every entry in the store until fn returns false.
+func (s *TypedStore[K, V]) Range(fn func(K, V) bool) {
+	s.data.Range(func(k, v interface{}) bool {
+		return fn(k.(K), v.(V))
+	})
+}
+
+// GetKeyMap returns a map of all keys.
+func (s *TypedStore[K, V]) GetKeyMap() map[K]bool {
+	keys := make(map[K]bool)
+	s.Range(func(k K, _ V) bool {
+		keys[k] = true
+		return true
+	})
+	return keys
+}
+
+// NotifyDidChange triggers a change notification.
+func (s *TypedStore[K, V]) NotifyDidChange() {
+	if s.lockable() {
+		s.cond.Broadcast()
+	}
+}
+
+// WaitForDataChange creates a waiting lock.
+func (s *TypedStore[K, V]) WaitForDataChange(ctx context.Context) {
+	wait := make(chan bool, 1)
+	if !s.lockable() {
+		return
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.cond.L.Lock()
+			s.cond.Broadcast()
+			s.cond.L.Unlock()
+			return
+		case <-wait:
+			return
+		}
+	}()
+
+	s.cond.L.Lock()
+	s.cond.Wait()
+	wait <- true
+	s.cond.L.Unlock()
+}
+
+// Flush clears the store.
+func (s *TypedStore[K, V]) Flush() {
+	s.Range(func(k K, _ V) bool {
+		s.Remove(k)
+		return true
+	})
+	if s.lockable() {
+		s.cond.Broadcast()
+	}
+}
+
+// OnInsertHandler adds a callback handler for inserts.
+func (s *TypedStore[K, V]) OnInsertHandler(f func(K, V)) {
+	s.onInsert = f
+}
+
+// OnUpdateHandler adds a callback handler for updates.
+func (s *TypedStore[K, V]) OnUpdateHandler(f func(K, V)) {
+	s.onUpdate = f
+}
+
+// OnRemoveHandler adds a callback handler for removals.
+func (s *TypedStore[K, V]) OnRemoveHandler(f func(K, V)) {
+	s.onRemove = f
+}
+
+// OnBatchInsertHandler adds a callback handler for batch inserts.
+func (s *TypedStore[K, V]) OnBatchInsertHandler(f func(TypedKV[K, V])) {
+	s.onBatchInsert = f
+}
+
+// OnBatchUpdateHandler adds a callback handler for batch updates.
+func (s *TypedStore[K, V]) OnBatchUpdateHandler(f func(TypedKV[K, V])) {
+	s.onBatchUpdate = f
+}
+
+// OnBatchRemoveHandler adds a callback handler for batch removals.
+func (s *TypedStore[K, V]) OnBatchRemoveHandler(f func(TypedKV[K, V])) {
+	s.onBatchRemove = f
+}
+
+// NewTyped returns a new, empty typed store.
+func NewTyped[K comparable, V any](lockable bool) *TypedStore[K, V] {
+	s := &TypedStore[K, V]{
+		count:         atomiccounter.New(),
+		onInsert:      func(K, V) {},
+		onUpdate:      func(K, V) {},
+		onRemove:      func(K, V) {},
+		onBatchInsert: func(TypedKV[K, V]) {},
+		onBatchUpdate: func(TypedKV[K, V]) {},
+		onBatchRemove: func(TypedKV[K, V]) {},
+		seq:           atomiccounter.New(),
+		lastSeq:       make(map[K]uint64),
+	}
+	if lockable {
+		s.cond = sync.NewCond(new(sync.Mutex))
+	}
+	return s
+}
+
+// typedJob is a single staged operation in a TypedBatch.
+type typedJob[K comparable, V any] struct {
+	method opp
+	key    K
+	value  V
+}
+
+// TypedBatch is the generic counterpart to Batch: Insert/InsertUnique/
+// Remove only stage jobs, Get reads through those pending writes, and
+// Commit verifies the batch's read-set hasn't been written since it
+// started before applying the write-set atomically, exactly like
+// Batch.Commit. ExecuteConcurrent remains as the lossy, no-conflict-
+// detection fallback for independent keys.
+type TypedBatch[K comparable, V any] struct {
+	sync.RWMutex
+	jobs     []*typedJob[K, V]
+	writes   map[K]*typedJob[K, V]
+	readSet  map[K]struct{}
+	startSeq uint64
+	store    *TypedStore[K, V]
+	done     bool
+}
+
+// Insert stages an insert job.
+func (b *TypedBatch[K, V]) Insert(key K, val V) {
+	b.Lock()
+	defer b.Unlock()
+	j := &typedJob[K, V]{method: oppInsert, key: key, value: val}
+	b.jobs = append(b.jobs, j)
+	b.writes[key] = j
+}
+
+// InsertUnique stages a unique-insert job.
+func (b *TypedBatch[K, V]) InsertUnique(key K, val V) {
+	b.Lock()
+	defer b.Unlock()
+	j := &typedJob[K, V]{method: oppInsertUnique, key: key, value: val}
+	b.jobs = append(b.jobs, j)
+	b.writes[key] = j
+}
+
+// Remove stages a remove job.
+func (b *TypedBatch[K, V]) Remove(key K) {
+	b.Lock()
+	defer b.Unlock()
+	j := &typedJob[K, V]{method: oppRemove, key: key}
+	b.jobs = append(b.jobs, j)
+	b.writes[key] = j
+}
+
+// Get reads key through the batch's pending writes, falling back to
+// the store's current value if the batch hasn't touched key. Reads
+// that fall through to the store are added to the batch's read-set and
+// checked for conflicts on Commit.
+func (b *TypedBatch[K, V]) Get(key K) (V, bool) {
+	b.Lock()
+	defer b.Unlock()
+	if j, ok := b.writes[key]; ok {
+		if j.method == oppRemove {
+			var zero V
+			return zero, false
+		}
+		return j.value, true
+	}
+	if b.readSet == nil {
+		b.readSet = make(map[K]struct{})
+	}
+	b.readSet[key] = struct{}{}
+	return b.store.Get(key)
+}
+
+// Commit verifies that no key in the batch's read-set has been written
+// since the batch started, then applies every staged write atomically
+// and fires the store's batch callbacks. It returns ErrConflict without
+// applying anything if verification fails, and ErrBatchClosed if the
+// batch was already committed or rolled back.
+func (b *TypedBatch[K, V]) Commit() error {
+	b.Lock()
+	if b.done {
+		b.Unlock()
+		return ErrBatchClosed
+	}
+	jobs := b.jobs
+	readSet := b.readSet
+	b.Unlock()
+
+	b.store.txMu.Lock()
+	defer b.store.txMu.Unlock()
+
+	for key := range readSet {
+		if b.store.latestSeq(key) > b.startSeq {
+			return ErrConflict
+		}
+	}
+
+	created := TypedKV[K, V]{}
+	updated := TypedKV[K, V]{}
+	deleted := TypedKV[K, V]{}
+	for _, j := range jobs {
+		switch j.method {
+		case oppInsert, oppInsertUnique:
+			unique := j.method == oppInsertUnique
+			doc, exists := b.store.insert(j.key, j.value, options{unique: unique, runCallbacks: false})
+			if !exists {
+				created[j.key] = doc
+			} else if !unique {
+				updated[j.key] = doc
+			}
+		case oppRemove:
+			if doc, success := b.store.remove(j.key, options{runCallbacks: false}); success {
+				deleted[j.key] = doc
+			}
+		}
+	}
+
+	b.Lock()
+	b.done = true
+	b.Unlock()
+
+	if len(created) > 0 && b.store.onBatchInsert != nil {
+		b.store.onBatchInsert(created)
+	}
+	if len(updated) > 0 && b.store.onBatchUpdate != nil {
+		b.store.onBatchUpdate(updated)
+	}
+	if len(deleted) > 0 && b.store.onBatchRemove != nil {
+		b.store.onBatchRemove(deleted)
+	}
+
+	return nil
+}
+
+// Rollback discards every staged job.
+func (b *TypedBatch[K, V]) Rollback() error {
+	b.Lock()
+	defer b.Unlock()
+	if b.done {
+		return ErrBatchClosed
+	}
+	b.jobs = nil
+	b.writes = nil
+	b.readSet = nil
+	b.done = true
+	return nil
+}
+
+// ExecuteConcurrent runs every staged job in its own goroutine and
+// fires the batch callbacks: faster than Commit but lossy under
+// contention, since concurrent jobs race on overlapping keys with no
+// conflict detection and no ordering guarantee. Prefer Commit unless
+// that race is acceptable.
+func (b *TypedBatch[K, V]) ExecuteConcurrent() {
+	b.Lock()
+	jobs := b.jobs
+	b.Unlock()
+
+	created := TypedKV[K, V]{}
+	updated := TypedKV[K, V]{}
+	deleted := TypedKV[K, V]{}
+	var resultMu sync.Mutex
+
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		go b.doConcurrent(j, created, updated, deleted, &resultMu, &wg)
+	}
+	wg.Wait()
+
+	if len(created) > 0 && b.store.onBatchInsert != nil {
+		b.store.onBatchInsert(created)
+	}
+	if len(updated) > 0 && b.store.onBatchUpdate != nil {
+		b.store.onBatchUpdate(updated)
+	}
+	if len(deleted) > 0 && b.store.onBatchRemove != nil {
+		b.store.onBatchRemove(deleted)
+	}
+}
+
+// doConcurrent applies one job to the store; resultMu guards the three
+// shared result maps, since plain maps are not safe for concurrent writes.
+func (b *TypedBatch[K, V]) doConcurrent(j *typedJob[K, V], created, updated, deleted TypedKV[K, V], resultMu *sync.Mutex, wg *sync.WaitGroup) {
+	defer wg.Done()
+	switch j.method {
+	case oppInsert, oppInsertUnique:
+		unique := j.method == oppInsertUnique
+		doc, exists := b.store.insert(j.key, j.value, options{unique: unique, runCallbacks: false})
+		resultMu.Lock()
+		if !exists {
+			created[j.key] = doc
+		} else if !unique {
+			updated[j.key] = doc
+		}
+		resultMu.Unlock()
+	case oppRemove:
+		if doc, success := b.store.remove(j.key, options{runCallbacks: false}); success {
+			resultMu.Lock()
+			deleted[j.key] = doc
+			resultMu.Unlock()
+		}
+	}
+}
+
+// Batch returns a new typed transaction. Reads it hasn't written itself
+// fall through to the store and are tracked for conflict detection;
+// nothing is applied to the store until Commit.
+func (s *TypedStore[K, V]) Batch() *TypedBatch[K, V] {
+	return &TypedBatch[K, V]{
+		store:    s,
+		jobs:     make([]*typedJob[K, V], 0),
+		writes:   make(map[K]*typedJob[K, V]),
+		readSet:  make(map[K]struct{}),
+		startSeq: s.seq.Get(),
+	}
+}
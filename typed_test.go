@@ -0,0 +1,107 @@
+// Edge Network
+// (c) 2021 Edge Network technologies Ltd.
+package atomicstore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestTypedStoreInsertGet(t *testing.T) {
+	s := NewTyped[string, int](false)
+	s.Insert("one", 1)
+	if v, ok := s.Get("one"); !ok || v != 1 {
+		t.Fatalf("Get: want (1, true), got (%v, %v)", v, ok)
+	}
+	if s.Len() != 1 {
+		t.Fatalf("Len: want 1, got %d", s.Len())
+	}
+}
+
+func TestTypedStoreNonStringKeyDoesNotPanic(t *testing.T) {
+	// The untyped Store panics on a non-string key (key.(string) inside
+	// insert/remove/GetKeyMap); TypedStore exists precisely so this works.
+	s := NewTyped[int, string](false)
+	s.Insert(42, "answer")
+	if v, ok := s.Get(42); !ok || v != "answer" {
+		t.Fatalf("Get: want (\"answer\", true), got (%v, %v)", v, ok)
+	}
+	if !s.GetKeyMap()[42] {
+		t.Fatalf("GetKeyMap: expected key 42 present")
+	}
+}
+
+func TestTypedBatchCommitDetectsConflict(t *testing.T) {
+	s := NewTyped[string, int](false)
+	s.Insert("bal", 100)
+
+	stale := s.Batch()
+	if v, ok := stale.Get("bal"); !ok || v != 100 {
+		t.Fatalf("Get: want (100, true), got (%v, %v)", v, ok)
+	}
+	stale.Insert("bal", 50)
+
+	fresh := s.Batch()
+	fresh.Get("bal")
+	fresh.Insert("bal", 999)
+	if err := fresh.Commit(); err != nil {
+		t.Fatalf("Commit: unexpected error %v", err)
+	}
+
+	if err := stale.Commit(); err != ErrConflict {
+		t.Fatalf("Commit: want ErrConflict, got %v", err)
+	}
+	if v, _ := s.Get("bal"); v != 999 {
+		t.Fatalf("store should still hold the winning commit's value, got %v", v)
+	}
+}
+
+// TestTypedStoreRecordKeepsLastSeqCurrent guards against record
+// assigning seq before taking verMu: if two concurrent writers to the
+// same key could acquire the lock in the opposite order from the
+// sequence numbers they were handed, lastSeq[key] could end up holding
+// a lower number than was actually last assigned, letting
+// TypedBatch.Commit's conflict check under-report conflicts.
+func TestTypedStoreRecordKeepsLastSeqCurrent(t *testing.T) {
+	s := NewTyped[string, int](false)
+
+	const n = 300
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			s.Insert("k", i)
+		}(i)
+	}
+	wg.Wait()
+
+	if got, want := s.latestSeq("k"), s.seq.Get(); got != want {
+		t.Fatalf("latestSeq(k): want %d (the last seq handed out), got %d", want, got)
+	}
+}
+
+// TestTypedExecuteConcurrentNoDataRace guards against the
+// created/updated/deleted TypedKV maps being written from multiple job
+// goroutines with no lock; run with -race.
+func TestTypedExecuteConcurrentNoDataRace(t *testing.T) {
+	s := NewTyped[string, int](false)
+	b := s.Batch()
+	const n = 200
+	for i := 0; i < n; i++ {
+		b.Insert(fmt.Sprintf("k%d", i), i)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.ExecuteConcurrent()
+	}()
+	wg.Wait()
+
+	if got := s.Len(); got != n {
+		t.Fatalf("Len: want %d, got %d", n, got)
+	}
+}